@@ -0,0 +1,45 @@
+package limitedstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tus/tusd"
+)
+
+func tenantKey(info tusd.FileInfo) string {
+	return info.MetaData["tenant"]
+}
+
+func TestEnsureSpaceOnlyEvictsWithinTheSameBucket(t *testing.T) {
+	a := assert.New(t)
+
+	store := NewWithPolicy(1000, zeroDataStore{}, &LargestFirst{})
+	store.Buckets = map[string]int64{"tenant-a": 100}
+	store.BucketKeyFunc = tenantKey
+
+	store.uploads = map[string]int64{"a1": 90, "b1": 900}
+	store.uploadKey = map[string]string{"a1": "tenant-a", "b1": ""}
+	store.bucketUsed = map[string]int64{"tenant-a": 90}
+	store.usedSize = 990
+
+	// Needs 20 more bytes in tenant-a's 100 byte bucket; only "a1" belongs
+	// to that bucket, so "b1" must survive even though it's bigger.
+	err := store.ensureSpace("tenant-a", 20)
+
+	a.NoError(err)
+	a.NotContains(store.uploads, "a1")
+	a.Contains(store.uploads, "b1")
+}
+
+func TestBucketKeyFallsBackToGlobalLimitForUnknownBuckets(t *testing.T) {
+	a := assert.New(t)
+
+	store := NewWithPolicy(1000, zeroDataStore{}, &LargestFirst{})
+	store.Buckets = map[string]int64{"tenant-a": 100}
+	store.BucketKeyFunc = tenantKey
+
+	info := tusd.FileInfo{MetaData: map[string]string{"tenant": "tenant-b"}}
+
+	a.Equal("", store.bucketKey(info))
+}
@@ -0,0 +1,106 @@
+package limitedstore
+
+import (
+	"sort"
+	"time"
+)
+
+// EvictionPolicy decides which uploads a LimitedStore should terminate in
+// order to free up space for a new one. LimitedStore calls Created, Touched
+// and Forgotten while holding its own lock, so implementations don't need
+// to do their own locking as long as they're only used by one LimitedStore.
+type EvictionPolicy interface {
+	// SelectVictims returns, in termination order, the ids of uploads that
+	// should be removed to free up at least needed bytes. uploads maps
+	// the id of every upload currently eligible for eviction to its size.
+	// LimitedStore stops terminating uploads as soon as enough space has
+	// been freed, so SelectVictims may return more ids than end up being
+	// used.
+	SelectVictims(needed int64, uploads map[string]int64) []string
+
+	// Created is called once a new upload has been created.
+	Created(id string)
+	// Touched is called whenever an upload is read from or written to.
+	Touched(id string)
+	// Forgotten is called once an upload has been terminated and should no
+	// longer be tracked.
+	Forgotten(id string)
+}
+
+// LargestFirst evicts the biggest uploads first. This was LimitedStore's
+// only, hard-coded behavior before EvictionPolicy was introduced.
+type LargestFirst struct{}
+
+func (p *LargestFirst) SelectVictims(needed int64, uploads map[string]int64) []string {
+	ids := make([]string, 0, len(uploads))
+	for id := range uploads {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return uploads[ids[i]] > uploads[ids[j]]
+	})
+
+	return ids
+}
+
+func (p *LargestFirst) Created(id string)   {}
+func (p *LargestFirst) Touched(id string)   {}
+func (p *LargestFirst) Forgotten(id string) {}
+
+// LRU evicts the least-recently-touched upload first, where an upload
+// counts as touched when it is created, read from (GetReader) or written to
+// (WriteChunk).
+type LRU struct {
+	times map[string]time.Time
+}
+
+// NewLRU creates a new, empty LRU eviction policy.
+func NewLRU() *LRU {
+	return &LRU{times: make(map[string]time.Time)}
+}
+
+func (p *LRU) SelectVictims(needed int64, uploads map[string]int64) []string {
+	return oldestFirst(uploads, p.times)
+}
+
+func (p *LRU) Created(id string) { p.times[id] = time.Now() }
+func (p *LRU) Touched(id string) { p.times[id] = time.Now() }
+
+func (p *LRU) Forgotten(id string) { delete(p.times, id) }
+
+// OldestFirst evicts the upload that has existed the longest, regardless of
+// whether it has been read from or written to since.
+type OldestFirst struct {
+	created map[string]time.Time
+}
+
+// NewOldestFirst creates a new, empty OldestFirst eviction policy.
+func NewOldestFirst() *OldestFirst {
+	return &OldestFirst{created: make(map[string]time.Time)}
+}
+
+func (p *OldestFirst) SelectVictims(needed int64, uploads map[string]int64) []string {
+	return oldestFirst(uploads, p.created)
+}
+
+func (p *OldestFirst) Created(id string) { p.created[id] = time.Now() }
+func (p *OldestFirst) Touched(id string) {}
+
+func (p *OldestFirst) Forgotten(id string) { delete(p.created, id) }
+
+// oldestFirst returns the ids present in uploads, ordered from oldest to
+// newest according to times. An id with no recorded timestamp is treated as
+// the oldest of all, so it's evicted first.
+func oldestFirst(uploads map[string]int64, times map[string]time.Time) []string {
+	ids := make([]string, 0, len(uploads))
+	for id := range uploads {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return times[ids[i]].Before(times[ids[j]])
+	})
+
+	return ids
+}
@@ -0,0 +1,127 @@
+package limitedstore
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tus/tusd"
+)
+
+// zeroDataStore is a no-op tusd.DataStore good enough to exercise
+// LimitedStore's own bookkeeping without touching a real backend.
+type zeroDataStore struct {
+	tusd.DataStore
+}
+
+func (store zeroDataStore) NewUpload(info tusd.FileInfo) (string, error) {
+	return "", nil
+}
+
+func (store zeroDataStore) WriteChunk(id string, offset int64, src io.Reader) (int64, error) {
+	return 0, nil
+}
+
+func (store zeroDataStore) GetReader(id string) (io.Reader, error) {
+	return nil, nil
+}
+
+func (store zeroDataStore) Terminate(id string) error {
+	return nil
+}
+
+func newUploads(ids ...string) map[string]int64 {
+	uploads := make(map[string]int64, len(ids))
+	for i, id := range ids {
+		uploads[id] = int64(i + 1)
+	}
+	return uploads
+}
+
+func TestLargestFirstSelectsBiggestUploadsFirst(t *testing.T) {
+	a := assert.New(t)
+
+	policy := &LargestFirst{}
+	uploads := map[string]int64{
+		"small":  10,
+		"medium": 20,
+		"big":    30,
+	}
+
+	victims := policy.SelectVictims(1, uploads)
+
+	a.Equal([]string{"big", "medium", "small"}, victims)
+}
+
+func TestLRUSelectsLeastRecentlyTouchedFirst(t *testing.T) {
+	a := assert.New(t)
+
+	policy := NewLRU()
+	uploads := newUploads("a", "b", "c")
+
+	policy.Created("a")
+	policy.Created("b")
+	policy.Created("c")
+
+	// Touching "a" should move it to the back of the eviction order.
+	policy.Touched("a")
+
+	victims := policy.SelectVictims(1, uploads)
+
+	a.Equal([]string{"b", "c", "a"}, victims)
+}
+
+func TestOldestFirstIgnoresTouches(t *testing.T) {
+	a := assert.New(t)
+
+	policy := NewOldestFirst()
+	uploads := newUploads("a", "b", "c")
+
+	policy.Created("a")
+	policy.Created("b")
+	policy.Created("c")
+
+	// Unlike LRU, touching "a" must not change its position: it's still
+	// the oldest upload by creation time.
+	policy.Touched("a")
+
+	victims := policy.SelectVictims(1, uploads)
+
+	a.Equal([]string{"a", "b", "c"}, victims)
+}
+
+func TestEnsureSpaceEvictsAllUploadsWhenNewUploadNeedsWholeStore(t *testing.T) {
+	a := assert.New(t)
+
+	store := NewWithPolicy(100, zeroDataStore{}, &LargestFirst{})
+	store.uploads = map[string]int64{
+		"a": 30,
+		"b": 30,
+		"c": 30,
+	}
+	store.usedSize = 90
+
+	err := store.ensureSpace("", 100)
+
+	a.NoError(err)
+	a.Empty(store.uploads)
+	a.EqualValues(0, store.usedSize)
+}
+
+func TestEnsureSpaceStopsAsSoonAsEnoughSpaceIsFreed(t *testing.T) {
+	a := assert.New(t)
+
+	store := NewWithPolicy(100, zeroDataStore{}, &LargestFirst{})
+	store.uploads = map[string]int64{
+		"a": 10,
+		"b": 80,
+	}
+	store.usedSize = 90
+
+	err := store.ensureSpace("", 50)
+
+	a.NoError(err)
+	// Evicting "b" alone already frees enough room, so "a" must survive.
+	a.Equal(map[string]int64{"a": 10}, store.uploads)
+	a.EqualValues(10, store.usedSize)
+}
@@ -1,60 +1,107 @@
 // Package limitedstore implements a simple wrapper around existing
 // datastores (tusd.DataStore) while limiting the used storage size.
 // It will start terminating existing uploads if not enough space is left in
-// order to create a new upload.
-// This package's functionality is very limited and naive. It will terminate
-// uploads whether they are finished yet or not and it won't terminate them
-// intelligently (e.g. bigger uploads first). Only one datastore is allowed to
-// access the underlying storage else the limited store will not function
-// properly. Two tusd.FileStore instances using the same directory, for example.
+// order to create a new upload. Which uploads get picked for termination is
+// decided by a pluggable EvictionPolicy; see eviction.go for the policies
+// shipped with this package.
+// Only one datastore is allowed to access the underlying storage else the
+// limited store will not function properly. Two tusd.FileStore instances
+// using the same directory, for example.
 // In addition the limited store will keep a list of the uploads' ids in memory
 // which may create a growing memory leak.
 package limitedstore
 
 import (
-	"github.com/tus/tusd"
+	"errors"
+	"io"
+	"log"
 	"sync"
-  "sort"
+
+	"github.com/tus/tusd"
 )
 
+// ErrInsufficientSpace is returned by NewUpload when ensureSpace could not
+// free enough room for the new upload, for example because every eligible
+// upload is pinned.
+var ErrInsufficientSpace = errors.New("limitedstore: not enough space could be freed for this upload")
+
+// LimitedStore wraps a tusd.DataStore, terminating existing uploads once the
+// total size of stored uploads would exceed StoreSize in order to make room
+// for a new one. Which uploads are terminated is decided by its
+// EvictionPolicy. Pinned uploads - such as those that have finished - are
+// never picked as eviction victims.
+//
+// If Buckets and BucketKeyFunc are set, uploads are additionally charged
+// against a per-bucket quota: BucketKeyFunc derives a bucket key (typically
+// a tenant or user id) from an upload's tusd.FileInfo, and that upload then
+// has to fit within its own bucket's share of Buckets and only evicts, and
+// is only evicted by, uploads in that same bucket. It still has to fit
+// within the global StoreSize as well. An upload whose key isn't present in
+// Buckets falls back to the global StoreSize limit instead.
 type LimitedStore struct {
-	StoreSize int64
+	StoreSize     int64
+	Buckets       map[string]int64
+	BucketKeyFunc func(tusd.FileInfo) string
 	tusd.DataStore
 
-	uploads  map[string]int64
-	usedSize int64
+	policy EvictionPolicy
+	state  StateStore
+
+	uploads    map[string]int64
+	uploadKey  map[string]string
+	usedSize   int64
+	bucketUsed map[string]int64
+	pinned     map[string]struct{}
+
+	// pendingDelete holds ids that have already been removed from the
+	// underlying DataStore and from the maps above, but whose state.Delete
+	// call hasn't succeeded yet. It lets a retried Terminate(id) retry just
+	// the persistence step instead of calling DataStore.Terminate again on
+	// an id that's already gone.
+	pendingDelete map[string]struct{}
 
 	mutex *sync.Mutex
 }
 
-// Pair structure to perform map-sorting
-type Pair struct {
-  key string
-  value int64
+// New creates a new limited store with the given size as the maximum storage
+// size. It evicts uploads using the LargestFirst policy, matching the
+// behavior of earlier versions of this package.
+func New(storeSize int64, dataStore tusd.DataStore) *LimitedStore {
+	return NewWithPolicy(storeSize, dataStore, &LargestFirst{})
 }
 
-type Pairlist []Pair
-
-func (p Pairlist) Len() int           { return len(p) }
-func (p Pairlist) Swap(i, j int)       { p[i], p[j] = p[j], p[i] }
-func (p Pairlist) Less(i, j int) bool  { return p[i].value < p[j].value }
-
-
-// Create a new limited store with the given size as the maximum storage size
-func New(storeSize int64, dataStore tusd.DataStore) *LimitedStore {
+// NewWithPolicy creates a new limited store which uses policy to select
+// which uploads to terminate whenever space is needed for a new one.
+func NewWithPolicy(storeSize int64, dataStore tusd.DataStore, policy EvictionPolicy) *LimitedStore {
 	return &LimitedStore{
-		StoreSize: storeSize,
-		DataStore: dataStore,
-		uploads:   make(map[string]int64),
-		mutex:     new(sync.Mutex),
+		StoreSize:     storeSize,
+		DataStore:     dataStore,
+		policy:        policy,
+		uploads:       make(map[string]int64),
+		uploadKey:     make(map[string]string),
+		bucketUsed:    make(map[string]int64),
+		pinned:        make(map[string]struct{}),
+		pendingDelete: make(map[string]struct{}),
+		mutex:         new(sync.Mutex),
 	}
 }
 
+// NewWithState creates a new limited store which additionally persists its
+// accounting of known uploads to state on every NewUpload and Terminate, so
+// that it can be rebuilt with Rehydrate after a restart.
+func NewWithState(storeSize int64, dataStore tusd.DataStore, policy EvictionPolicy, state StateStore) *LimitedStore {
+	store := NewWithPolicy(storeSize, dataStore, policy)
+	store.state = state
+	return store
+}
+
 func (store *LimitedStore) NewUpload(info tusd.FileInfo) (string, error) {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	if err := store.ensureSpace(info.Size); err != nil {
+	key := store.bucketKey(info)
+
+	if err := store.ensureSpace(key, info.Size); err != nil {
 		return "", err
 	}
 
@@ -63,12 +110,70 @@ func (store *LimitedStore) NewUpload(info tusd.FileInfo) (string, error) {
 		return "", err
 	}
 
+	if store.state != nil {
+		if err := store.state.Put(id, UploadState{Size: info.Size, BucketKey: key}); err != nil {
+			// The upload was never counted against the quota, so roll it
+			// back on the underlying DataStore instead of leaving it
+			// orphaned there with no id the caller could use to clean it
+			// up itself.
+			if rollbackErr := store.DataStore.Terminate(id); rollbackErr != nil {
+				log.Printf("limitedstore: failed to roll back upload %q after state persistence error: %v", id, rollbackErr)
+			}
+			return "", err
+		}
+	}
+
 	store.usedSize += info.Size
 	store.uploads[id] = info.Size
+	store.uploadKey[id] = key
+	if key != "" {
+		store.bucketUsed[key] += info.Size
+	}
+	store.policy.Created(id)
 
 	return id, nil
 }
 
+// bucketKey returns the bucket info's upload should be charged against, or
+// "" to fall back to the global limit - either because no BucketKeyFunc is
+// configured, or because the key it derives isn't one of Buckets.
+func (store *LimitedStore) bucketKey(info tusd.FileInfo) string {
+	if store.BucketKeyFunc == nil {
+		return ""
+	}
+
+	key := store.BucketKeyFunc(info)
+	if _, ok := store.Buckets[key]; !ok {
+		return ""
+	}
+
+	return key
+}
+
+// WriteChunk passes through to the underlying DataStore, notifying the
+// eviction policy that the upload was touched so that policies such as LRU
+// can keep their bookkeeping up to date.
+func (store *LimitedStore) WriteChunk(id string, offset int64, src io.Reader) (int64, error) {
+	n, err := store.DataStore.WriteChunk(id, offset, src)
+
+	store.mutex.Lock()
+	store.policy.Touched(id)
+	store.mutex.Unlock()
+
+	return n, err
+}
+
+// GetReader passes through to the underlying DataStore, notifying the
+// eviction policy that the upload was touched so that policies such as LRU
+// can keep their bookkeeping up to date.
+func (store *LimitedStore) GetReader(id string) (io.Reader, error) {
+	store.mutex.Lock()
+	store.policy.Touched(id)
+	store.mutex.Unlock()
+
+	return store.DataStore.GetReader(id)
+}
+
 func (store *LimitedStore) Terminate(id string) error {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
@@ -76,49 +181,187 @@ func (store *LimitedStore) Terminate(id string) error {
 	return store.terminate(id)
 }
 
-func (store *LimitedStore) terminate(id string) error {
-	err := store.DataStore.Terminate(id)
-	if err != nil {
+// Pin protects the given upload from ever being picked as an eviction
+// victim by ensureSpace, until it is Unpin'd again.
+func (store *LimitedStore) Pin(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.uploads[id]; !ok {
+		return tusd.ErrNotFound
+	}
+
+	store.pinned[id] = struct{}{}
+
+	if err := store.persistState(id); err != nil {
+		delete(store.pinned, id)
 		return err
 	}
 
+	return nil
+}
+
+// Unpin allows the given upload to be picked as an eviction victim again.
+// Unpinning an upload that isn't pinned, or doesn't exist, is a no-op.
+func (store *LimitedStore) Unpin(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.pinned[id]; !ok {
+		return nil
+	}
+
+	delete(store.pinned, id)
+
+	if err := store.persistState(id); err != nil {
+		store.pinned[id] = struct{}{}
+		return err
+	}
+
+	return nil
+}
+
+// FinishUpload marks id as finished on the underlying DataStore, if it
+// implements tusd.FinisherDataStore, and then pins it so that a finished
+// upload is never wiped out by ensureSpace to make room for another one.
+func (store *LimitedStore) FinishUpload(id string) error {
+	if finisher, ok := store.DataStore.(tusd.FinisherDataStore); ok {
+		if err := finisher.FinishUpload(id); err != nil {
+			return err
+		}
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.pinned[id] = struct{}{}
+
+	if err := store.persistState(id); err != nil {
+		delete(store.pinned, id)
+		return err
+	}
+
+	return nil
+}
+
+// persistState writes id's current size, bucket key and pinned status to
+// the configured StateStore, if any. It's a no-op for untracked ids, since
+// there's nothing meaningful to persist for them.
+func (store *LimitedStore) persistState(id string) error {
+	if store.state == nil {
+		return nil
+	}
+
+	size, ok := store.uploads[id]
+	if !ok {
+		return nil
+	}
+
+	_, pinned := store.pinned[id]
+
+	return store.state.Put(id, UploadState{
+		Size:      size,
+		BucketKey: store.uploadKey[id],
+		Pinned:    pinned,
+	})
+}
+
+func (store *LimitedStore) terminate(id string) error {
+	if _, ok := store.uploads[id]; ok {
+		if err := store.DataStore.Terminate(id); err != nil {
+			return err
+		}
+
+		store.forget(id)
+	} else if _, ok := store.pendingDelete[id]; !ok {
+		// Neither tracked nor awaiting a retried state.Delete - most
+		// likely a retry after a previous call already finished
+		// successfully. Avoid calling DataStore.Terminate again on an id
+		// the store no longer tracks.
+		return nil
+	}
+
+	if store.state != nil {
+		if err := store.state.Delete(id); err != nil {
+			return err
+		}
+	}
+
+	delete(store.pendingDelete, id)
+	return nil
+}
+
+// forget removes id from the store's accounting after it has already been
+// terminated on the underlying DataStore, and marks it as pending a
+// state.Delete call so a failed persistence attempt can be retried without
+// calling DataStore.Terminate on id a second time.
+func (store *LimitedStore) forget(id string) {
 	size := store.uploads[id]
+	key := store.uploadKey[id]
+
 	delete(store.uploads, id)
+	delete(store.uploadKey, id)
+	delete(store.pinned, id)
 	store.usedSize -= size
+	if key != "" {
+		store.bucketUsed[key] -= size
+	}
+	store.policy.Forgotten(id)
 
-	return nil
+	store.pendingDelete[id] = struct{}{}
 }
 
-// Ensure enough space is available to store an upload of the specified size.
-// It will terminate uploads until enough space is freed.
-func (store *LimitedStore) ensureSpace(size int64) error {
-	if (store.usedSize + size) <= store.StoreSize {
+// ensureSpace makes sure enough space is available to store an upload of
+// the given size, both within key's bucket (if any) and within the store's
+// overall StoreSize, terminating uploads selected by the store's
+// EvictionPolicy - restricted to the same bucket - until both are
+// satisfied. Pinned uploads are never considered as victims; if the
+// unpinned uploads in the bucket alone can't free enough of both,
+// ErrInsufficientSpace is returned.
+func (store *LimitedStore) ensureSpace(key string, size int64) error {
+	fits := func() bool {
+		if (store.usedSize + size) > store.StoreSize {
+			return false
+		}
+		if key != "" && (store.bucketUsed[key]+size) > store.Buckets[key] {
+			return false
+		}
+		return true
+	}
+
+	if fits() {
 		// Enough space is available to store the new upload
 		return nil
 	}
-  sorted_uploads := make(Pairlist, len(store.uploads))
-  i := 0
-  for u,h := range store.uploads {
-    sorted_uploads[i] = Pair{u, h}
-    i++
-  }
-  sort.Sort(sorted_uploads)
-
-  // Reverse traversal through the
-  // uploads in terms of size, biggest upload first
-  j := len(store.uploads)
-	for j >= 0 {
-    id := sorted_uploads[j].key
+
+	for _, id := range store.policy.SelectVictims(size, store.evictionCandidates(key)) {
 		if err := store.terminate(id); err != nil {
 			return err
 		}
 
-		if (store.usedSize + size) <= store.StoreSize {
+		if fits() {
 			// Enough space has been freed to store the new upload
 			return nil
 		}
-    j--
 	}
 
-	return nil
+	return ErrInsufficientSpace
+}
+
+// evictionCandidates returns the sizes of every upload in key's bucket (or,
+// if key is "", every upload that isn't charged against any bucket) that
+// isn't pinned and may therefore be picked as an eviction victim.
+func (store *LimitedStore) evictionCandidates(key string) map[string]int64 {
+	candidates := make(map[string]int64, len(store.uploads))
+	for id, size := range store.uploads {
+		if _, ok := store.pinned[id]; ok {
+			continue
+		}
+		if store.uploadKey[id] != key {
+			continue
+		}
+		candidates[id] = size
+	}
+
+	return candidates
 }
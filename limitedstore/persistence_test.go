@@ -0,0 +1,113 @@
+package limitedstore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tus/tusd"
+)
+
+// trackingDataStore hands out incrementing ids from NewUpload and records
+// every id passed to Terminate, so tests can assert on rollback behavior.
+type trackingDataStore struct {
+	tusd.DataStore
+
+	nextID     int
+	terminated []string
+}
+
+func (s *trackingDataStore) NewUpload(info tusd.FileInfo) (string, error) {
+	s.nextID++
+	return fmt.Sprintf("id%d", s.nextID), nil
+}
+
+func (s *trackingDataStore) Terminate(id string) error {
+	s.terminated = append(s.terminated, id)
+	return nil
+}
+
+var errPersist = errors.New("persist failed")
+
+// erroringStateStore fails every operation, to exercise NewUpload's rollback
+// path when persistence can't keep up with the underlying DataStore.
+type erroringStateStore struct{}
+
+func (erroringStateStore) Put(id string, state UploadState) error { return errPersist }
+func (erroringStateStore) Delete(id string) error                 { return errPersist }
+func (erroringStateStore) All() (map[string]UploadState, error)   { return nil, errPersist }
+
+func TestNewUploadRollsBackOnPersistFailure(t *testing.T) {
+	a := assert.New(t)
+
+	ds := &trackingDataStore{}
+	store := NewWithState(100, ds, &LargestFirst{}, erroringStateStore{})
+
+	id, err := store.NewUpload(tusd.FileInfo{Size: 10})
+
+	a.Equal(errPersist, err)
+	a.Empty(id)
+	a.Empty(store.uploads)
+	a.EqualValues(0, store.usedSize)
+	// The orphaned upload must be cleaned up on the underlying DataStore,
+	// since the caller never receives an id to terminate it with itself.
+	a.Equal([]string{"id1"}, ds.terminated)
+}
+
+func TestTerminateIsNoOpForUntrackedUpload(t *testing.T) {
+	a := assert.New(t)
+
+	ds := &trackingDataStore{}
+	store := NewWithPolicy(100, ds, &LargestFirst{})
+
+	err := store.Terminate("unknown")
+
+	a.NoError(err)
+	a.Empty(ds.terminated)
+}
+
+// flakyStateStore fails Delete until it has been called failUntil times,
+// so tests can exercise a retried Terminate actually retrying persistence.
+type flakyStateStore struct {
+	failUntil int
+	deletes   int
+}
+
+func (s *flakyStateStore) Put(id string, state UploadState) error { return nil }
+
+func (s *flakyStateStore) Delete(id string) error {
+	s.deletes++
+	if s.deletes <= s.failUntil {
+		return errPersist
+	}
+	return nil
+}
+
+func (s *flakyStateStore) All() (map[string]UploadState, error) {
+	return make(map[string]UploadState), nil
+}
+
+func TestTerminateRetriesPersistenceWithoutReterminatingOnDataStore(t *testing.T) {
+	a := assert.New(t)
+
+	ds := &trackingDataStore{}
+	state := &flakyStateStore{failUntil: 1}
+	store := NewWithState(100, ds, &LargestFirst{}, state)
+	store.uploads["a"] = 10
+	store.usedSize = 10
+
+	err := store.Terminate("a")
+	a.Equal(errPersist, err)
+	// The upload must already be gone from accounting, even though
+	// persistence hasn't confirmed the deletion yet.
+	a.Empty(store.uploads)
+	a.Equal([]string{"a"}, ds.terminated)
+
+	err = store.Terminate("a")
+	a.NoError(err)
+	// The retry must have retried state.Delete, not called
+	// DataStore.Terminate a second time.
+	a.Equal([]string{"a"}, ds.terminated)
+	a.Equal(2, state.deletes)
+}
@@ -0,0 +1,84 @@
+package limitedstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tus/tusd"
+)
+
+// finishingDataStore is a tusd.FinisherDataStore that just records which
+// ids were finished.
+type finishingDataStore struct {
+	zeroDataStore
+	finished []string
+}
+
+func (s *finishingDataStore) FinishUpload(id string) error {
+	s.finished = append(s.finished, id)
+	return nil
+}
+
+func TestPinReturnsErrNotFoundForUnknownUpload(t *testing.T) {
+	a := assert.New(t)
+
+	store := NewWithPolicy(100, zeroDataStore{}, &LargestFirst{})
+
+	err := store.Pin("unknown")
+
+	a.Equal(tusd.ErrNotFound, err)
+}
+
+func TestUnpinMakesUploadEvictableAgain(t *testing.T) {
+	a := assert.New(t)
+
+	store := NewWithPolicy(100, zeroDataStore{}, &LargestFirst{})
+	store.uploads = map[string]int64{"a": 90}
+	store.usedSize = 90
+
+	a.NoError(store.Pin("a"))
+	a.NoError(store.Unpin("a"))
+
+	err := store.ensureSpace("", 20)
+
+	a.NoError(err)
+	a.Empty(store.uploads)
+}
+
+func TestFinishUploadDelegatesAndPinsTheUpload(t *testing.T) {
+	a := assert.New(t)
+
+	ds := &finishingDataStore{}
+	store := NewWithPolicy(100, ds, &LargestFirst{})
+	store.uploads = map[string]int64{"a": 90}
+	store.usedSize = 90
+
+	a.NoError(store.FinishUpload("a"))
+	a.Equal([]string{"a"}, ds.finished)
+
+	// A finished upload must be pinned, so it survives ensureSpace even
+	// though it's the only upload available to evict.
+	err := store.ensureSpace("", 20)
+
+	a.Equal(ErrInsufficientSpace, err)
+	a.Equal(map[string]int64{"a": 90}, store.uploads)
+}
+
+func TestEnsureSpaceSkipsPinnedUploads(t *testing.T) {
+	a := assert.New(t)
+
+	store := NewWithPolicy(100, zeroDataStore{}, &LargestFirst{})
+	store.uploads = map[string]int64{
+		"a": 30,
+		"b": 60,
+	}
+	store.usedSize = 90
+	store.pinned["b"] = struct{}{}
+
+	err := store.ensureSpace("", 50)
+
+	a.Equal(ErrInsufficientSpace, err)
+	// "b" is pinned, so only "a" could be evicted, which isn't enough to
+	// free the requested space.
+	a.Equal(map[string]int64{"b": 60}, store.uploads)
+}
@@ -0,0 +1,90 @@
+package limitedstore
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrCannotRehydrate is returned by Rehydrate when the store has neither a
+// StateStore configured nor an underlying DataStore that implements
+// IDLister, so there is no way to reconstruct its accounting.
+var ErrCannotRehydrate = errors.New("limitedstore: no state store or IDLister available to rehydrate from")
+
+// IDLister is an optional interface a DataStore can implement to let
+// LimitedStore rebuild its accounting without a StateStore, by listing
+// every upload id it currently knows about.
+type IDLister interface {
+	ListIDs() ([]string, error)
+}
+
+// Rehydrate reconstructs the store's in-memory record of known uploads,
+// their sizes, bucket keys and pinned status after a restart, which
+// otherwise starts out empty and would silently let the store exceed
+// StoreSize (or a bucket's share of it) - or let a finished upload be
+// evicted. If the store has a StateStore, its
+// records are used directly. Otherwise, the underlying DataStore is asked
+// to list its ids via IDLister and each one is looked up with GetInfo, its
+// bucket key re-derived with BucketKeyFunc; this fallback is much slower,
+// only works if the DataStore supports it, and can't recover pinned status
+// since that isn't part of a tusd.FileInfo.
+func (store *LimitedStore) Rehydrate(ctx context.Context) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.state != nil {
+		all, err := store.state.All()
+		if err != nil {
+			return err
+		}
+
+		store.setUploads(all)
+		return nil
+	}
+
+	lister, ok := store.DataStore.(IDLister)
+	if !ok {
+		return ErrCannotRehydrate
+	}
+
+	ids, err := lister.ListIDs()
+	if err != nil {
+		return err
+	}
+
+	all := make(map[string]UploadState, len(ids))
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		info, err := store.DataStore.GetInfo(id)
+		if err != nil {
+			return err
+		}
+
+		all[id] = UploadState{Size: info.Size, BucketKey: store.bucketKey(info)}
+	}
+
+	store.setUploads(all)
+	return nil
+}
+
+func (store *LimitedStore) setUploads(all map[string]UploadState) {
+	store.uploads = make(map[string]int64, len(all))
+	store.uploadKey = make(map[string]string, len(all))
+	store.bucketUsed = make(map[string]int64)
+	store.pinned = make(map[string]struct{})
+	store.usedSize = 0
+
+	for id, state := range all {
+		store.uploads[id] = state.Size
+		store.uploadKey[id] = state.BucketKey
+		store.usedSize += state.Size
+		if state.BucketKey != "" {
+			store.bucketUsed[state.BucketKey] += state.Size
+		}
+		if state.Pinned {
+			store.pinned[id] = struct{}{}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package limitedstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tus/tusd"
+)
+
+// listingDataStore is a tusd.DataStore that also implements IDLister, for
+// exercising Rehydrate's no-StateStore fallback path.
+type listingDataStore struct {
+	tusd.DataStore
+	ids   []string
+	infos map[string]tusd.FileInfo
+}
+
+func (s *listingDataStore) ListIDs() ([]string, error) {
+	return s.ids, nil
+}
+
+func (s *listingDataStore) GetInfo(id string) (tusd.FileInfo, error) {
+	return s.infos[id], nil
+}
+
+func TestRehydrateFallsBackToIDListerAndGetInfo(t *testing.T) {
+	a := assert.New(t)
+
+	ds := &listingDataStore{
+		ids: []string{"a", "b"},
+		infos: map[string]tusd.FileInfo{
+			"a": {Size: 10, MetaData: map[string]string{"tenant": "tenant-a"}},
+			"b": {Size: 20},
+		},
+	}
+
+	store := NewWithPolicy(100, ds, &LargestFirst{})
+	store.Buckets = map[string]int64{"tenant-a": 50}
+	store.BucketKeyFunc = tenantKey
+
+	a.NoError(store.Rehydrate(context.Background()))
+
+	a.Equal(map[string]int64{"a": 10, "b": 20}, store.uploads)
+	a.EqualValues(30, store.usedSize)
+	a.EqualValues(10, store.bucketUsed["tenant-a"])
+}
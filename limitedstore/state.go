@@ -0,0 +1,140 @@
+package limitedstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// UploadState is what a StateStore persists about a single upload: enough
+// for LimitedStore to rebuild its accounting, including which bucket (if
+// any) the upload is charged against and whether it was pinned.
+type UploadState struct {
+	Size      int64
+	BucketKey string
+	Pinned    bool
+}
+
+// StateStore lets LimitedStore persist the uploads it knows about, so that
+// Rehydrate can rebuild that accounting after a restart without relying on
+// the underlying DataStore to enumerate its uploads.
+type StateStore interface {
+	// Put records that the given upload exists with the given state.
+	Put(id string, state UploadState) error
+	// Delete removes any record of the given upload.
+	Delete(id string) error
+	// All returns every upload currently recorded in the state store,
+	// mapping its id to its state.
+	All() (map[string]UploadState, error)
+}
+
+// FileStateStore is a StateStore backed by a single JSON file, replaced
+// atomically via a temp-file-plus-rename on every write so that a crash or
+// write failure can't leave it truncated or corrupted. It trades
+// performance for not requiring any dependency beyond the standard
+// library, which makes it a reasonable default for small setups.
+type FileStateStore struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// NewFileStateStore creates a FileStateStore persisting to the given path.
+// The file is created on the first call to Put if it doesn't exist yet.
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{path: path}
+}
+
+func (s *FileStateStore) Put(id string, state UploadState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	all, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	all[id] = state
+	return s.write(all)
+}
+
+func (s *FileStateStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	all, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	delete(all, id)
+	return s.write(all)
+}
+
+func (s *FileStateStore) All() (map[string]UploadState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.read()
+}
+
+func (s *FileStateStore) read() (map[string]UploadState, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return make(map[string]UploadState), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	all := make(map[string]UploadState)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &all); err != nil {
+			return nil, err
+		}
+	}
+
+	return all, nil
+}
+
+// write replaces the state file atomically: it writes the new contents to
+// a temp file in the same directory and renames it over s.path, so a crash
+// or write failure partway through can never leave s.path truncated or
+// corrupted - at worst, the temp file is left behind and the previous
+// state survives untouched.
+func (s *FileStateStore) write(all map[string]UploadState) error {
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".limitedstore-state-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package limitedstore
+
+import (
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+)
+
+var boltBucketName = []byte("limitedstore")
+
+// BoltStateStore is a StateStore backed by a bolt database, suitable for
+// production deployments that want crash-safe persistence without running
+// a separate database service.
+type BoltStateStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStateStore opens (creating if necessary) a bolt database at path
+// and returns a StateStore backed by it. The caller is responsible for
+// closing the returned store's underlying DB once it's no longer needed.
+func NewBoltStateStore(path string) (*BoltStateStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucketName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStateStore{db: db}, nil
+}
+
+func (s *BoltStateStore) Put(id string, state UploadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketName).Put([]byte(id), data)
+	})
+}
+
+func (s *BoltStateStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketName).Delete([]byte(id))
+	})
+}
+
+func (s *BoltStateStore) All() (map[string]UploadState, error) {
+	all := make(map[string]UploadState)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketName).ForEach(func(k, v []byte) error {
+			var state UploadState
+			if err := json.Unmarshal(v, &state); err != nil {
+				return err
+			}
+			all[string(k)] = state
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return all, nil
+}
+
+// Close closes the underlying bolt database.
+func (s *BoltStateStore) Close() error {
+	return s.db.Close()
+}
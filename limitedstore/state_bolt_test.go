@@ -0,0 +1,31 @@
+package limitedstore
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltStateStorePersistsAcrossInstances(t *testing.T) {
+	a := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "state.bolt")
+
+	first, err := NewBoltStateStore(path)
+	a.NoError(err)
+
+	a.NoError(first.Put("a", UploadState{Size: 10}))
+	a.NoError(first.Put("b", UploadState{Size: 20, BucketKey: "tenant-a"}))
+	a.NoError(first.Delete("a"))
+	a.NoError(first.Close())
+
+	second, err := NewBoltStateStore(path)
+	a.NoError(err)
+	defer second.Close()
+
+	all, err := second.All()
+
+	a.NoError(err)
+	a.Equal(map[string]UploadState{"b": {Size: 20, BucketKey: "tenant-a"}}, all)
+}
@@ -0,0 +1,91 @@
+package limitedstore
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStateStorePersistsAcrossInstances(t *testing.T) {
+	a := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	first := NewFileStateStore(path)
+	a.NoError(first.Put("a", UploadState{Size: 10}))
+	a.NoError(first.Put("b", UploadState{Size: 20, BucketKey: "tenant-a"}))
+	a.NoError(first.Delete("a"))
+
+	second := NewFileStateStore(path)
+	all, err := second.All()
+
+	a.NoError(err)
+	a.Equal(map[string]UploadState{"b": {Size: 20, BucketKey: "tenant-a"}}, all)
+}
+
+func TestFileStateStoreWriteLeavesNoTempFiles(t *testing.T) {
+	a := assert.New(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	store := NewFileStateStore(path)
+	a.NoError(store.Put("a", UploadState{Size: 10}))
+
+	entries, err := ioutil.ReadDir(dir)
+	a.NoError(err)
+	a.Len(entries, 1)
+	a.Equal("state.json", entries[0].Name())
+}
+
+func TestRehydrateReplaysStateStore(t *testing.T) {
+	a := assert.New(t)
+
+	state := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+	a.NoError(state.Put("a", UploadState{Size: 10}))
+	a.NoError(state.Put("b", UploadState{Size: 20, BucketKey: "tenant-a"}))
+
+	store := NewWithState(100, zeroDataStore{}, &LargestFirst{}, state)
+	store.Buckets = map[string]int64{"tenant-a": 50}
+
+	a.NoError(store.Rehydrate(context.Background()))
+	a.Equal(map[string]int64{"a": 10, "b": 20}, store.uploads)
+	a.EqualValues(30, store.usedSize)
+	a.EqualValues(20, store.bucketUsed["tenant-a"])
+}
+
+func TestFinishUploadPinPersistsAcrossRehydrate(t *testing.T) {
+	a := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	state := NewFileStateStore(path)
+
+	store := NewWithState(100, zeroDataStore{}, &LargestFirst{}, state)
+	store.uploads["a"] = 90
+	store.usedSize = 90
+	a.NoError(store.persistState("a"))
+	a.NoError(store.FinishUpload("a"))
+
+	// A fresh store built from the same StateStore must come back with "a"
+	// pinned, not just present.
+	second := NewWithState(100, zeroDataStore{}, &LargestFirst{}, NewFileStateStore(path))
+	a.NoError(second.Rehydrate(context.Background()))
+
+	err := second.ensureSpace("", 20)
+
+	a.Equal(ErrInsufficientSpace, err)
+	a.Contains(second.uploads, "a")
+}
+
+func TestRehydrateWithoutStateOrListerFails(t *testing.T) {
+	a := assert.New(t)
+
+	store := NewWithPolicy(100, zeroDataStore{}, &LargestFirst{})
+
+	err := store.Rehydrate(context.Background())
+
+	a.Equal(ErrCannotRehydrate, err)
+}